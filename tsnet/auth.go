@@ -0,0 +1,35 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsnet
+
+import (
+	"context"
+	"fmt"
+
+	"tailscale.com/ipn"
+)
+
+// Login switches the server to profile and blocks until it reaches
+// ipn.Running or ctx is done.
+func (s *Server) Login(ctx context.Context, profile ipn.LoginProfile) error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+	if err := s.lb.SwitchProfile(profile.ID); err != nil {
+		return fmt.Errorf("tsnet: switching to profile %q: %w", profile.ID, err)
+	}
+	s.lb.StartLoginInteractive()
+	_, err := s.Up(ctx)
+	return err
+}
+
+// Logout logs the server out of its current tailnet and blocks until the
+// control server acknowledges it.
+func (s *Server) Logout(ctx context.Context) error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+	return s.lb.LogoutSync(ctx)
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsnet
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// certRenewalMargin is how long before a certificate's expiry tsnet starts
+// trying to fetch a replacement.
+const certRenewalMargin = 7 * 24 * time.Hour
+
+// ListenTLS announces on the Tailscale network and returns a TLS listener.
+// Certificates for the connecting SNI ServerName are obtained automatically
+// via the tailnet's LetsEncrypt integration (the same one backing
+// `tailscale cert`), cached under Server.Dir, and renewed in the background
+// as they approach expiry.
+//
+// It will start the server if it has not been started yet.
+func (s *Server) ListenTLS(network, addr string) (net.Listener, error) {
+	ln, err := s.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(ln, &tls.Config{
+		GetCertificate: s.getCertificate,
+	}), nil
+}
+
+func (s *Server) certDir() (string, error) {
+	dir := filepath.Join(s.rootPath, "certs")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// getCertificate is a tls.Config.GetCertificate implementation that serves
+// (and transparently renews) certificates obtained from the tailnet's
+// LetsEncrypt integration, keyed by SNI ServerName.
+func (s *Server) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	domain := hello.ServerName
+	if domain == "" {
+		return nil, fmt.Errorf("tsnet: no SNI ServerName in TLS handshake")
+	}
+
+	s.certMu.Lock()
+	cert, ok := s.certCache[domain]
+	s.certMu.Unlock()
+	if ok && !certNeedsRenewal(cert) {
+		return cert, nil
+	}
+
+	cert, err := s.loadOrFetchCert(hello.Context(), domain)
+	if err != nil {
+		return nil, err
+	}
+
+	s.certMu.Lock()
+	if s.certCache == nil {
+		s.certCache = map[string]*tls.Certificate{}
+	}
+	s.certCache[domain] = cert
+	s.certMu.Unlock()
+
+	s.scheduleRenewal(domain, cert)
+	return cert, nil
+}
+
+// certFetch is the in-flight state for a single domain's loadOrFetchCert
+// call, so that concurrent callers (e.g. two simultaneous handshakes for a
+// brand-new SNI name) join the same fetch instead of each issuing their own
+// CertPair RPC and cert-file write.
+type certFetch struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+func (s *Server) loadOrFetchCert(ctx context.Context, domain string) (*tls.Certificate, error) {
+	s.certMu.Lock()
+	if f, ok := s.certFetches[domain]; ok {
+		s.certMu.Unlock()
+		<-f.done
+		return f.cert, f.err
+	}
+	f := &certFetch{done: make(chan struct{})}
+	if s.certFetches == nil {
+		s.certFetches = map[string]*certFetch{}
+	}
+	s.certFetches[domain] = f
+	s.certMu.Unlock()
+
+	f.cert, f.err = s.loadOrFetchCertOnce(ctx, domain)
+
+	s.certMu.Lock()
+	delete(s.certFetches, domain)
+	s.certMu.Unlock()
+	close(f.done)
+
+	return f.cert, f.err
+}
+
+func (s *Server) loadOrFetchCertOnce(ctx context.Context, domain string) (*tls.Certificate, error) {
+	dir, err := s.certDir()
+	if err != nil {
+		return nil, err
+	}
+	certFile := filepath.Join(dir, domain+".crt")
+	keyFile := filepath.Join(dir, domain+".key")
+
+	if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil && !certNeedsRenewal(&cert) {
+		return &cert, nil
+	}
+
+	lc, err := s.LocalClient()
+	if err != nil {
+		return nil, err
+	}
+	certPEM, keyPEM, err := lc.CertPair(ctx, domain)
+	if err != nil {
+		return nil, fmt.Errorf("tsnet: fetching cert for %q: %w", domain, err)
+	}
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// scheduleRenewal arms a background renewal timer for domain, unless one is
+// already running; getCertificate calls this on every cache miss, and two
+// concurrent misses for the same domain must not each arm their own timer.
+func (s *Server) scheduleRenewal(domain string, cert *tls.Certificate) {
+	s.certMu.Lock()
+	if s.certRenewing == nil {
+		s.certRenewing = map[string]bool{}
+	}
+	if s.certRenewing[domain] {
+		s.certMu.Unlock()
+		return
+	}
+	s.certRenewing[domain] = true
+	s.certMu.Unlock()
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		s.certMu.Lock()
+		delete(s.certRenewing, domain)
+		s.certMu.Unlock()
+		return
+	}
+	d := time.Until(leaf.NotAfter) - certRenewalMargin
+	if d < 0 {
+		d = 0
+	}
+	go func() {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-s.shutdownCtx.Done():
+			s.certMu.Lock()
+			delete(s.certRenewing, domain)
+			s.certMu.Unlock()
+			return
+		}
+		cert, err := s.loadOrFetchCert(s.shutdownCtx, domain)
+		if err != nil {
+			s.logf("tsnet: background renewal of cert for %q failed: %v", domain, err)
+			s.certMu.Lock()
+			delete(s.certRenewing, domain)
+			s.certMu.Unlock()
+			return
+		}
+		s.certMu.Lock()
+		s.certCache[domain] = cert
+		delete(s.certRenewing, domain) // scheduleRenewal below re-arms it
+		s.certMu.Unlock()
+		s.scheduleRenewal(domain, cert)
+	}()
+}
+
+func certNeedsRenewal(cert *tls.Certificate) bool {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return true
+	}
+	return time.Until(leaf.NotAfter) < certRenewalMargin
+}
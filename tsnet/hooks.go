@@ -0,0 +1,37 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsnet
+
+import "tailscale.com/ipn"
+
+// watchNotifications feeds Server.OnStateChange and Server.OnPeerChange
+// from the IPN bus until the server is closed. It's only started when at
+// least one of those hooks is set.
+func (s *Server) watchNotifications() {
+	ch, err := s.WatchIPNBus(s.shutdownCtx, ipn.NotifyInitialState|ipn.NotifyWatchEngineUpdates)
+	if err != nil {
+		s.logf("tsnet: watchNotifications: %v", err)
+		return
+	}
+	for n := range ch {
+		if n.State != nil && s.OnStateChange != nil {
+			s.OnStateChange(*n.State)
+		}
+		if n.NetMap != nil && s.OnPeerChange != nil {
+			lc, err := s.LocalClient()
+			if err != nil {
+				continue
+			}
+			st, err := lc.Status(s.shutdownCtx)
+			if err != nil {
+				s.logf("tsnet: watchNotifications: Status: %v", err)
+				continue
+			}
+			for _, ps := range st.Peer {
+				s.OnPeerChange(ps)
+			}
+		}
+	}
+}
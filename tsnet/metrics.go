@@ -0,0 +1,31 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsnet
+
+import (
+	"net/http"
+
+	"tailscale.com/metrics"
+)
+
+// MetricsHandler returns an http.Handler serving wgengine and magicsock
+// counters in Prometheus text exposition format.
+//
+// TODO(bradfitz): add netstack counters once netstack.Impl exposes an
+// ExpVar (or equivalent) to read them from.
+//
+// It returns an error, rather than matching net/http.Handler's usual bare
+// return, because it needs Start to have run first; every other tsnet
+// method that shares that requirement (LocalClient, HTTPClient, Up, ...)
+// follows the same shape.
+func (s *Server) MetricsHandler() (http.Handler, error) {
+	if err := s.Start(); err != nil {
+		return nil, err
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metrics.WritePrometheusExpvar(w, s.eng.ExpVar())
+		metrics.WritePrometheusExpvar(w, s.magicConn.ExpVar())
+	}), nil
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsnet
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// LocalClient returns a LocalClient bound to this Server's own localapi
+// socket, so multiple Servers in one process don't clobber each other.
+//
+// It returns an error, unlike the zero-arg tailscale.LocalClient{}, because
+// it starts the server if not already started; every other tsnet method
+// with that requirement (HTTPClient, Up, WatchIPNBus, ...) follows suit.
+func (s *Server) LocalClient() (*tailscale.LocalClient, error) {
+	if err := s.Start(); err != nil {
+		return nil, err
+	}
+	return &tailscale.LocalClient{Dial: s.localAPIDial}, nil
+}
+
+// HTTPClient returns an http.Client that dials this Server's in-process
+// localapi socket regardless of the request URL's host, for raw HTTP
+// access to localapi endpoints LocalClient doesn't wrap.
+//
+// It will start the server if it has not been started yet.
+func (s *Server) HTTPClient() (*http.Client, error) {
+	if err := s.Start(); err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: s.localAPIDial,
+		},
+	}, nil
+}
+
+// Up connects the server to the tailnet and blocks until it reaches
+// ipn.Running, returning its status.
+func (s *Server) Up(ctx context.Context) (*ipnstate.Status, error) {
+	lc, err := s.LocalClient()
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := lc.WatchIPNBus(ctx, ipn.NotifyInitialState)
+	if err != nil {
+		return nil, fmt.Errorf("tsnet: %w", err)
+	}
+	defer watcher.Close()
+
+	for {
+		n, err := watcher.Next()
+		if err != nil {
+			return nil, fmt.Errorf("tsnet: %w", err)
+		}
+		if n.State != nil && *n.State == ipn.Running {
+			return lc.StatusWithoutPeers(ctx)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+	}
+}
+
+// WatchIPNBus streams login/netmap/state notifications matching mask until
+// ctx is canceled or the Server is closed.
+func (s *Server) WatchIPNBus(ctx context.Context, mask ipn.NotifyWatchOpt) (<-chan ipn.Notify, error) {
+	lc, err := s.LocalClient()
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := lc.WatchIPNBus(ctx, mask)
+	if err != nil {
+		return nil, fmt.Errorf("tsnet: %w", err)
+	}
+
+	ch := make(chan ipn.Notify)
+	go func() {
+		defer close(ch)
+		defer watcher.Close()
+		for {
+			n, err := watcher.Next()
+			if err != nil {
+				return
+			}
+			select {
+			case ch <- *n:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
@@ -9,6 +9,7 @@ package tsnet
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
@@ -20,11 +21,11 @@ import (
 	"time"
 
 	"inet.af/netaddr"
-	"tailscale.com/client/tailscale"
 	"tailscale.com/control/controlclient"
 	"tailscale.com/envknob"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/ipn/localapi"
 	"tailscale.com/ipn/store"
 	"tailscale.com/ipn/store/mem"
@@ -33,6 +34,7 @@ import (
 	"tailscale.com/smallzstd"
 	"tailscale.com/types/logger"
 	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/magicsock"
 	"tailscale.com/wgengine/monitor"
 	"tailscale.com/wgengine/netstack"
 )
@@ -65,6 +67,28 @@ type Server struct {
 	// as an Ephemeral node (https://tailscale.com/kb/1111/ephemeral-nodes/).
 	Ephemeral bool
 
+	// AuthKey, if non-empty, is the auth key to create the node and
+	// will be preferred over the TS_AUTHKEY environment variable.
+	AuthKey string
+
+	// ControlURL, if non-empty, overrides the coordination server URL,
+	// for pinning to a self-hosted control plane (e.g. Headscale)
+	// instead of the default Tailscale control server.
+	ControlURL string
+
+	// AuthURLHandler, if non-nil, is called with the URL the user should
+	// visit to finish an interactive login, in place of the default
+	// behavior of logging it via Logf every few seconds.
+	AuthURLHandler func(url string)
+
+	// OnStateChange, if non-nil, is called whenever the node's IPN state
+	// changes (e.g. NeedsLogin, Starting, Running).
+	OnStateChange func(ipn.State)
+
+	// OnPeerChange, if non-nil, is called with the current PeerStatus of
+	// each peer in the tailnet whenever the netmap changes.
+	OnPeerChange func(*ipnstate.PeerStatus)
+
 	initOnce         sync.Once
 	initErr          error
 	lb               *ipnlocal.LocalBackend
@@ -78,6 +102,18 @@ type Server struct {
 	mu        sync.Mutex
 	listeners map[listenKey]*listener
 	dialer    *tsdial.Dialer
+
+	certMu       sync.Mutex
+	certCache    map[string]*tls.Certificate
+	certFetches  map[string]*certFetch
+	certRenewing map[string]bool
+
+	localAPIDial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	packetListeners map[listenKey]*packetListener
+
+	eng       wgengine.Engine
+	magicConn *magicsock.Conn
 }
 
 // Dial connects to the address on the tailnet.
@@ -105,12 +141,26 @@ func (s *Server) Close() error {
 	s.linkMon.Close()
 	s.localAPIListener.Close()
 
+	// Collect what to close under the lock, then close outside it: both
+	// listener.Close and packetListener.Close re-lock s.mu themselves to
+	// remove their own entry, so calling them while s.mu is held deadlocks.
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	var listeners []*listener
 	for _, ln := range s.listeners {
+		listeners = append(listeners, ln)
+	}
+	var packetListeners []*packetListener
+	for _, pc := range s.packetListeners {
+		packetListeners = append(packetListeners, pc)
+	}
+	s.mu.Unlock()
+
+	for _, ln := range listeners {
 		ln.Close()
 	}
-	s.listeners = nil
+	for _, pc := range packetListeners {
+		pc.Close()
+	}
 
 	return nil
 }
@@ -185,6 +235,8 @@ func (s *Server) start() error {
 	if !ok {
 		return fmt.Errorf("%T is not a wgengine.InternalsGetter", eng)
 	}
+	s.eng = eng
+	s.magicConn = magicConn
 
 	ns, err := netstack.Create(logf, tunDev, eng, magicConn, s.dialer)
 	if err != nil {
@@ -192,6 +244,7 @@ func (s *Server) start() error {
 	}
 	ns.ProcessLocalIPs = true
 	ns.ForwardTCPIn = s.forwardTCP
+	ns.ForwardUDPIn = s.forwardUDP
 	if err := ns.Start(); err != nil {
 		return fmt.Errorf("failed to start netstack: %w", err)
 	}
@@ -230,7 +283,13 @@ func (s *Server) start() error {
 	prefs := ipn.NewPrefs()
 	prefs.Hostname = s.hostname
 	prefs.WantRunning = true
-	authKey := os.Getenv("TS_AUTHKEY")
+	prefs.ControlURL = s.ControlURL
+	authKey := s.AuthKey
+	if authKey == "" {
+		// TODO(bradfitz): remove this fallback once TS_AUTHKEY callers have
+		// had time to migrate to the explicit Server.AuthKey field.
+		authKey = os.Getenv("TS_AUTHKEY")
+	}
 	err = lb.Start(ipn.Options{
 		StateKey:    ipn.GlobalDaemonStateKey,
 		UpdatePrefs: prefs,
@@ -258,14 +317,22 @@ func (s *Server) start() error {
 	// TODO(maisem): Rename nettest package to remove "test".
 	lal := nettest.Listen("local-tailscaled.sock:80")
 	s.localAPIListener = lal
+	// s.localAPIDial, not the package-level tailscale.TailscaledDialer, is
+	// how this Server's LocalClient/HTTPClient reach its own localapi.
+	// Setting the package-level dialer here would make the last-started
+	// Server in the process clobber every other Server's localapi access.
+	s.localAPIDial = lal.Dial
 
-	// Override the Tailscale client to use the in-process listener.
-	tailscale.TailscaledDialer = lal.Dial
 	go func() {
 		if err := http.Serve(lal, lah); err != nil {
 			logf("localapi serve error: %v", err)
 		}
 	}()
+
+	if s.OnStateChange != nil || s.OnPeerChange != nil {
+		go s.watchNotifications()
+	}
+
 	return nil
 }
 
@@ -290,7 +357,11 @@ func (s *Server) printAuthURLLoop() {
 		}
 		st := s.lb.StatusWithoutPeers()
 		if st.AuthURL != "" {
-			s.logf("To start this tsnet server, restart with TS_AUTHKEY set, or go to: %s", st.AuthURL)
+			if s.AuthURLHandler != nil {
+				s.AuthURLHandler(st.AuthURL)
+			} else {
+				s.logf("To start this tsnet server, set Server.AuthKey, or go to: %s", st.AuthURL)
+			}
 		}
 		select {
 		case <-time.After(5 * time.Second):
@@ -363,6 +434,12 @@ func getTSNetDir(logf logger.Logf, confDir, prog string) (string, error) {
 // Listen announces only on the Tailscale network.
 // It will start the server if it has not been started yet.
 func (s *Server) Listen(network, addr string) (net.Listener, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("tsnet: network %q not supported, use ListenPacket for UDP", network)
+	}
+
 	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, fmt.Errorf("tsnet: %w", err)
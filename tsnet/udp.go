@@ -0,0 +1,269 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsnet
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ListenPacket announces a UDP endpoint on the Tailscale network.
+// It will start the server if it has not been started yet.
+func (s *Server) ListenPacket(network, addr string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("tsnet: network %q not supported, use Listen for TCP", network)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("tsnet: %w", err)
+	}
+
+	if err := s.Start(); err != nil {
+		return nil, err
+	}
+
+	key := listenKey{network, host, port}
+	pc := &packetListener{
+		s:             s,
+		key:           key,
+		addr:          addr,
+		conns:         make(map[string]net.Conn),
+		pkts:          make(chan udpPacket),
+		closeCh:       make(chan struct{}),
+		readDeadline:  makePipeDeadline(),
+		writeDeadline: makePipeDeadline(),
+	}
+	s.mu.Lock()
+	if s.packetListeners == nil {
+		s.packetListeners = map[listenKey]*packetListener{}
+	}
+	if _, ok := s.packetListeners[key]; ok {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("tsnet: packet listener already open for %s, %s", network, addr)
+	}
+	s.packetListeners[key] = pc
+	s.mu.Unlock()
+	return pc, nil
+}
+
+// forwardUDP demultiplexes an inbound UDP flow from netstack to the
+// packetListener registered for port, by port number only (tsnet doesn't
+// support binding to a specific Tailscale IP yet).
+func (s *Server) forwardUDP(c net.Conn, port uint16) {
+	portStr := fmt.Sprint(port)
+	var pc *packetListener
+	s.mu.Lock()
+	for k, v := range s.packetListeners {
+		if k.port == portStr {
+			pc = v
+			break
+		}
+	}
+	s.mu.Unlock()
+	if pc == nil {
+		c.Close()
+		return
+	}
+	go pc.readFrom(c)
+}
+
+type udpPacket struct {
+	b    []byte
+	addr net.Addr
+}
+
+// packetListener is a net.PacketConn whose datagrams arrive over the
+// tailnet via netstack's UDP forwarder. Each distinct remote endpoint shows
+// up as its own forwarded net.Conn; packetListener multiplexes them onto a
+// single ReadFrom/WriteTo surface, keyed by remote address.
+type packetListener struct {
+	s    *Server
+	key  listenKey
+	addr string
+
+	pkts    chan udpPacket
+	closeCh chan struct{} // closed by Close; pkts itself is never closed, so an in-flight send on it can't panic
+
+	readDeadline  pipeDeadline
+	writeDeadline pipeDeadline
+
+	mu     sync.Mutex
+	closed bool
+	conns  map[string]net.Conn // remote addr string -> forwarded conn
+}
+
+// readFrom reads datagrams off a single forwarded flow c and feeds them
+// into the shared pkts channel until c is closed or pc is closed.
+func (pc *packetListener) readFrom(c net.Conn) {
+	pc.mu.Lock()
+	if pc.closed {
+		pc.mu.Unlock()
+		c.Close()
+		return
+	}
+	pc.conns[c.RemoteAddr().String()] = c
+	pc.mu.Unlock()
+
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := c.Read(buf)
+		if n > 0 {
+			b := make([]byte, n)
+			copy(b, buf[:n])
+			select {
+			case pc.pkts <- udpPacket{b, c.RemoteAddr()}:
+			case <-pc.closeCh:
+				c.Close()
+				return
+			case <-pc.s.shutdownCtx.Done():
+				c.Close()
+				return
+			}
+		}
+		if err != nil {
+			pc.mu.Lock()
+			delete(pc.conns, c.RemoteAddr().String())
+			pc.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (pc *packetListener) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-pc.pkts:
+		n := copy(b, p.b)
+		return n, p.addr, nil
+	case <-pc.closeCh:
+		return 0, nil, fmt.Errorf("tsnet: %w", net.ErrClosed)
+	case <-pc.readDeadline.wait():
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+// WriteTo writes a reply datagram to addr. It only works for addresses tsnet
+// has already seen an inbound datagram from, since tsnet has no way to
+// originate a new UDP flow out through netstack's forwarder.
+func (pc *packetListener) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-pc.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	pc.mu.Lock()
+	c, ok := pc.conns[addr.String()]
+	pc.mu.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("tsnet: no forwarded flow for %v", addr)
+	}
+	return c.Write(b)
+}
+
+func (pc *packetListener) Close() error {
+	pc.s.mu.Lock()
+	if v, ok := pc.s.packetListeners[pc.key]; ok && v == pc {
+		delete(pc.s.packetListeners, pc.key)
+	}
+	pc.s.mu.Unlock()
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.closed {
+		return nil
+	}
+	pc.closed = true
+	for _, c := range pc.conns {
+		c.Close()
+	}
+	close(pc.closeCh)
+	return nil
+}
+
+func (pc *packetListener) LocalAddr() net.Addr { return packetAddr{pc} }
+
+func (pc *packetListener) SetDeadline(t time.Time) error {
+	pc.readDeadline.set(t)
+	pc.writeDeadline.set(t)
+	return nil
+}
+
+func (pc *packetListener) SetReadDeadline(t time.Time) error {
+	pc.readDeadline.set(t)
+	return nil
+}
+
+func (pc *packetListener) SetWriteDeadline(t time.Time) error {
+	pc.writeDeadline.set(t)
+	return nil
+}
+
+type packetAddr struct{ pc *packetListener }
+
+func (a packetAddr) Network() string { return a.pc.key.network }
+func (a packetAddr) String() string  { return a.pc.addr }
+
+// pipeDeadline is a goroutine-safe read/write deadline, the same technique
+// net.Pipe uses internally, adapted here since packetListener's ReadFrom
+// and WriteTo aren't backed by the runtime network poller and so need an
+// explicit signal when a deadline fires.
+type pipeDeadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makePipeDeadline() pipeDeadline {
+	return pipeDeadline{cancel: make(chan struct{})}
+}
+
+// set arms the deadline for t, closing the channel returned by wait once it
+// passes. A zero t disarms it; a t already in the past fires immediately.
+func (d *pipeDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to finish closing cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	switch {
+	case t.IsZero():
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+	case time.Until(t) > 0:
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		d.timer = time.AfterFunc(time.Until(t), func() { close(d.cancel) })
+	case !closed:
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that's closed once the deadline is exceeded.
+func (d *pipeDeadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
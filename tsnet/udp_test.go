@@ -0,0 +1,83 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsnet
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestPacketListener() *packetListener {
+	s := &Server{packetListeners: map[listenKey]*packetListener{}}
+	s.shutdownCtx, s.shutdownCancel = context.WithCancel(context.Background())
+	key := listenKey{"udp", "", "53"}
+	pc := &packetListener{
+		s:             s,
+		key:           key,
+		addr:          ":53",
+		conns:         make(map[string]net.Conn),
+		pkts:          make(chan udpPacket),
+		closeCh:       make(chan struct{}),
+		readDeadline:  makePipeDeadline(),
+		writeDeadline: makePipeDeadline(),
+	}
+	s.packetListeners[key] = pc
+	return pc
+}
+
+type remoteAddrConn struct {
+	net.Conn
+	raddr net.Addr
+}
+
+func (c remoteAddrConn) RemoteAddr() net.Addr { return c.raddr }
+
+// TestPacketListenerCloseDuringSend exercises readFrom sending a datagram
+// concurrently with Close, which used to panic by closing pc.pkts out from
+// under an in-flight send.
+func TestPacketListenerCloseDuringSend(t *testing.T) {
+	pc := newTestPacketListener()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		a, b := net.Pipe()
+		// Every net.Pipe conn reports the same "pipe" address; give each
+		// flow its own remote address, as netstack's forwarded flows have,
+		// so pc.conns tracks (and Close closes) all of them.
+		c := remoteAddrConn{a, &net.UDPAddr{IP: net.IPv4(100, 64, 0, 1), Port: 1000 + i}}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pc.readFrom(c)
+		}()
+		go b.Write([]byte("hello"))
+	}
+
+	// Drain a few datagrams concurrently with Close to make sure a send
+	// racing the close doesn't panic.
+	go func() {
+		for i := 0; i < 3; i++ {
+			pc.ReadFrom(make([]byte, 16))
+		}
+	}()
+
+	pc.Close()
+	wg.Wait()
+}
+
+func TestPacketListenerReadDeadline(t *testing.T) {
+	pc := newTestPacketListener()
+	defer pc.Close()
+
+	pc.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, _, err := pc.ReadFrom(make([]byte, 16))
+	if err != os.ErrDeadlineExceeded {
+		t.Fatalf("ReadFrom error = %v, want os.ErrDeadlineExceeded", err)
+	}
+}